@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileCheckpointer", func() {
+	var path string
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("", "eksctl-checkpoint")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "checkpoint.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(filepath.Dir(path))
+	})
+
+	It("lets a resumed TaskTree skip tasks that already completed", func() {
+		ran := map[string]int{}
+		makeTask := func(name string) Task {
+			return &taskWithoutParams{
+				info: name,
+				call: func(ctx context.Context, errs chan error) error {
+					ran[name]++
+					go func() {
+						errs <- nil
+						close(errs)
+					}()
+					return nil
+				},
+			}
+		}
+
+		checkpointer, err := NewFileCheckpointer(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		firstRun := &TaskTree{Parallel: false, Checkpointer: checkpointer, ClusterName: "test-cluster"}
+		firstRun.Append(makeTask("one"))
+		firstRun.Append(makeTask("two"))
+		Expect(firstRun.DoAllSync()).To(HaveLen(0))
+		Expect(ran).To(Equal(map[string]int{"one": 1, "two": 1}))
+
+		// simulate a fresh process resuming, reloading state from disk
+		reloaded, err := NewFileCheckpointer(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		secondRun := &TaskTree{Parallel: false, Checkpointer: reloaded, ClusterName: "test-cluster"}
+		secondRun.Append(makeTask("one"))
+		secondRun.Append(makeTask("two"))
+		Expect(secondRun.DoAllSync()).To(HaveLen(0))
+		Expect(ran).To(Equal(map[string]int{"one": 1, "two": 1}))
+	})
+
+	It("scopes completions by cluster name", func() {
+		checkpointer, err := NewFileCheckpointer(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(checkpointer.MarkCompleted("cluster-a", `create nodegroup "bar"`)).To(Succeed())
+
+		doneForA, err := checkpointer.Completed("cluster-a", `create nodegroup "bar"`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doneForA).To(BeTrue())
+
+		doneForB, err := checkpointer.Completed("cluster-b", `create nodegroup "bar"`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doneForB).To(BeFalse())
+	})
+
+	It("propagates to a nested TaskTree so individual nodegroup tasks resume independently", func() {
+		// mirrors the shape CreateTasksForClusterWithNodeGroups builds: a
+		// sequential root (control plane, then nodegroups) wrapping a
+		// parallel nested sub-tree (one task per nodegroup); "bar" and
+		// "foo" run concurrently, so ran needs a mutex like the other
+		// parallel-tasks tests in this package
+		var mu sync.Mutex
+		ran := map[string]int{}
+		makeTask := func(name string) Task {
+			return &taskWithoutParams{
+				info: name,
+				call: func(ctx context.Context, errs chan error) error {
+					mu.Lock()
+					ran[name]++
+					mu.Unlock()
+					go func() {
+						errs <- nil
+						close(errs)
+					}()
+					return nil
+				},
+			}
+		}
+
+		fooShouldFail := true
+		makeFooTask := func() Task {
+			return &taskWithoutParams{
+				info: `create nodegroup "foo"`,
+				call: func(ctx context.Context, errs chan error) error {
+					mu.Lock()
+					ran[`create nodegroup "foo"`]++
+					mu.Unlock()
+					go func() {
+						if fooShouldFail {
+							errs <- fmt.Errorf("throttled")
+						} else {
+							errs <- nil
+						}
+						close(errs)
+					}()
+					return nil
+				},
+			}
+		}
+
+		buildTree := func(checkpointer Checkpointer) *TaskTree {
+			nodeGroups := &TaskTree{Parallel: true, Sub: true}
+			nodeGroups.Append(makeTask(`create nodegroup "bar"`))
+			nodeGroups.Append(makeFooTask())
+
+			root := &TaskTree{Parallel: false, Checkpointer: checkpointer, ClusterName: "test-cluster"}
+			root.Append(makeTask(`create cluster control plane "test-cluster"`))
+			root.Append(nodeGroups)
+			return root
+		}
+
+		checkpointer, err := NewFileCheckpointer(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		errs := buildTree(checkpointer).DoAllSync()
+		Expect(errs).To(HaveLen(1))
+		Expect(errs[0].Error()).To(Equal("throttled"))
+		Expect(ran).To(Equal(map[string]int{
+			`create cluster control plane "test-cluster"`: 1,
+			`create nodegroup "bar"`:                      1,
+			`create nodegroup "foo"`:                      1,
+		}))
+
+		// "foo" never got checkpointed because it failed; resuming should
+		// only re-run it, skipping the control plane and "bar" individually
+		// rather than re-running the whole nested nodegroups sub-tree
+		fooShouldFail = false
+		reloaded, err := NewFileCheckpointer(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(buildTree(reloaded).DoAllSync()).To(HaveLen(0))
+		Expect(ran).To(Equal(map[string]int{
+			`create cluster control plane "test-cluster"`: 1,
+			`create nodegroup "bar"`:                      1,
+			`create nodegroup "foo"`:                      2,
+		}))
+	})
+})
@@ -0,0 +1,529 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kris-nova/logger"
+)
+
+// Task is a common interface for the stack manager tasks. Implementations
+// should return promptly once ctx is cancelled, delivering ctx.Err() (or a
+// more specific error) on errs instead of continuing to poll AWS.
+type Task interface {
+	Describe() string
+	Do(ctx context.Context, errs chan error) error
+}
+
+// TaskTree wraps a set of tasks
+type TaskTree struct {
+	Tasks    []Task
+	Parallel bool
+	Sub      bool
+	DryRun   bool
+
+	// MaxConcurrency caps how many of this tree's Tasks run at once when
+	// Parallel is true. Zero (the default) means unbounded, preserving the
+	// existing fan-out-everything behaviour. Set it to avoid overwhelming
+	// CloudFormation with e.g. 20+ concurrent nodegroup creations.
+	MaxConcurrency int
+
+	// RetryPolicy, if set, causes each of this tree's Tasks to be re-run
+	// automatically when it fails with a retryable error (e.g. CloudFormation
+	// throttling), instead of failing the whole tree on one transient error.
+	RetryPolicy *RetryPolicy
+
+	// Label is an optional human-readable name for this sub-tree, used to
+	// build the Path of TaskEvents emitted from within it (e.g. "nodegroups").
+	// It has no effect on Describe().
+	Label string
+
+	// OnEvent, if set, is called for every TaskEvent emitted while this tree
+	// runs. It is propagated down to nested TaskTrees that don't set their
+	// own OnEvent, so a handler attached to the root tree observes the whole
+	// run, e.g. to render live nodegroup/stack progress or to stream NDJSON
+	// for `--output json`. Calls are serialized: even though a Parallel
+	// tree's tasks emit TaskStarted/TaskFinished from their own goroutines,
+	// TaskTree guarantees OnEvent itself is never invoked concurrently, so a
+	// consumer can safely append events to a shared slice or tree without
+	// its own locking.
+	OnEvent func(TaskEvent)
+
+	// Checkpointer, if set together with ClusterName, is consulted before
+	// each task runs and updated after it succeeds, so a resumed run of an
+	// equivalent tree for the same cluster can skip tasks that already
+	// completed. See Checkpointer's doc comment for the scope of this.
+	Checkpointer Checkpointer
+	// ClusterName scopes Checkpointer lookups; required when Checkpointer is set
+	ClusterName string
+
+	path    []string
+	eventMu *sync.Mutex
+}
+
+// TaskEventType identifies what happened in a TaskEvent
+type TaskEventType int
+
+const (
+	// TaskStarted is emitted right before one of a tree's Tasks (a leaf task
+	// or a nested TaskTree) is run; retries of that task don't emit it again
+	TaskStarted TaskEventType = iota
+	// TaskFinished is emitted once that task's final result is known, after
+	// any retries, successful or not
+	TaskFinished
+	// TaskSkipped is emitted for tasks that never ran, either because the
+	// tree's context was cancelled before they were started or because the
+	// Checkpointer reports them as already completed
+	TaskSkipped
+	// TreeEntered is emitted when a TaskTree starts running its Tasks
+	TreeEntered
+	// TreeExited is emitted when a TaskTree has finished running its Tasks
+	TreeExited
+)
+
+func (e TaskEventType) String() string {
+	switch e {
+	case TaskStarted:
+		return "TaskStarted"
+	case TaskFinished:
+		return "TaskFinished"
+	case TaskSkipped:
+		return "TaskSkipped"
+	case TreeEntered:
+		return "TreeEntered"
+	case TreeExited:
+		return "TreeExited"
+	default:
+		return "Unknown"
+	}
+}
+
+// TaskEvent describes a single state change of a task or sub-tree while a
+// TaskTree runs, suitable for driving a progress UI or a `--output json`
+// NDJSON stream
+type TaskEvent struct {
+	Type      TaskEventType
+	Info      string
+	Path      []string
+	Err       error
+	Timestamp time.Time
+	Duration  time.Duration
+}
+
+// emit calls OnEvent, if set, stamping the event with this tree's path.
+// Delivery is serialized through eventMu so OnEvent is never invoked
+// concurrently, even when emit is called from multiple goroutines running
+// a Parallel tree's tasks.
+func (t *TaskTree) emit(evt TaskEvent) {
+	if t.OnEvent == nil {
+		return
+	}
+	evt.Path = t.path
+	evt.Timestamp = time.Now()
+	if t.eventMu != nil {
+		t.eventMu.Lock()
+		defer t.eventMu.Unlock()
+	}
+	t.OnEvent(evt)
+}
+
+// adopt propagates this tree's OnEvent handler (and the mutex serializing
+// calls to it), Checkpointer, ClusterName and path down to a child task,
+// when that child is itself a TaskTree, so a handler attached to the root
+// observes events from every level of nesting, and a Checkpointer set on
+// the root reaches nested sub-trees (e.g. the per-nodegroup fan-out under a
+// cluster-creation tree) instead of only ever seeing the outermost tree's
+// tasks
+func (t *TaskTree) adopt(task Task) {
+	sub, ok := task.(*TaskTree)
+	if !ok {
+		return
+	}
+	if sub.OnEvent == nil {
+		sub.OnEvent = t.OnEvent
+		sub.eventMu = t.eventMu
+	}
+	if sub.Checkpointer == nil {
+		sub.Checkpointer = t.Checkpointer
+	}
+	if sub.ClusterName == "" {
+		sub.ClusterName = t.ClusterName
+	}
+	label := sub.Label
+	if label == "" {
+		label = sub.Describe()
+	}
+	sub.path = append(append([]string{}, t.path...), label)
+}
+
+// RetryPolicy configures automatic retries of a TaskTree's tasks
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times to run a task, including the
+	// first attempt. Values <= 1 disable retries.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff, which otherwise doubles on every attempt
+	MaxBackoff time.Duration
+	// Jitter adds up to this much random delay on top of each backoff, to
+	// avoid every retrying task hammering AWS on the same schedule
+	Jitter time.Duration
+	// Retryable decides whether a given error should be retried. A nil
+	// Retryable retries every error.
+	Retryable func(error) bool
+}
+
+func (r *RetryPolicy) maxAttempts() int {
+	if r == nil || r.MaxAttempts < 1 {
+		return 1
+	}
+	return r.MaxAttempts
+}
+
+func (r *RetryPolicy) shouldRetry(err error) bool {
+	if r == nil || err == nil {
+		return false
+	}
+	if r.Retryable == nil {
+		return true
+	}
+	return r.Retryable(err)
+}
+
+func (r *RetryPolicy) backoff(attempt int) time.Duration {
+	if r == nil {
+		return 0
+	}
+	d := r.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if r.MaxBackoff > 0 && d > r.MaxBackoff {
+			d = r.MaxBackoff
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(r.Jitter)))
+	}
+	return d
+}
+
+// WeightedTask may be implemented by a Task to hint its relative cost to
+// the scheduler. When a TaskTree is bounded by MaxConcurrency, tasks with a
+// higher Weight are given a worker slot before lighter ones, regardless of
+// append order, so the biggest or most critical work isn't left queued
+// behind smaller tasks.
+type WeightedTask interface {
+	Task
+	Weight() int
+}
+
+// weightOf returns a task's scheduling weight, defaulting to 0 for tasks
+// that don't implement WeightedTask
+func weightOf(task Task) int {
+	if w, ok := task.(WeightedTask); ok {
+		return w.Weight()
+	}
+	return 0
+}
+
+// Append new tasks to the set
+func (t *TaskTree) Append(newTasks ...Task) {
+	t.Tasks = append(t.Tasks, newTasks...)
+}
+
+// Len returns number of tasks in the set
+func (t *TaskTree) Len() int {
+	return len(t.Tasks)
+}
+
+// describeItem renders task the way it appears inside a parent tree's
+// Describe(): a sub-tree holding exactly one task collapses into that
+// task's own description (recursively, for sub-trees nested several levels
+// deep) instead of wrapping it in its own "1 task: { ... }"/"1 sub-task: {
+// ... }", so a tree built purely to fan out per-item work (e.g. one
+// sub-tree per requested nodegroup) reads the same whether it holds one
+// item or many.
+func describeItem(task Task) string {
+	sub, isTree := task.(*TaskTree)
+	if !isTree {
+		return task.Describe()
+	}
+	if len(sub.Tasks) != 1 {
+		return sub.Describe()
+	}
+	inner := sub.Tasks[0]
+	desc := describeItem(inner)
+	if _, innerIsTree := inner.(*TaskTree); !innerIsTree && sub.RetryPolicy.maxAttempts() > 1 {
+		desc = fmt.Sprintf("%s (retry x%d)", desc, sub.RetryPolicy.maxAttempts())
+	}
+	return desc
+}
+
+// Describe the set
+func (t *TaskTree) Describe() string {
+	descriptions := make([]string, 0, len(t.Tasks))
+	for _, task := range t.Tasks {
+		desc := describeItem(task)
+		if _, isTree := task.(*TaskTree); !isTree && t.RetryPolicy.maxAttempts() > 1 {
+			desc = fmt.Sprintf("%s (retry x%d)", desc, t.RetryPolicy.maxAttempts())
+		}
+		descriptions = append(descriptions, desc)
+	}
+	items := strings.Join(descriptions, ", ")
+
+	var msg string
+	switch len(descriptions) {
+	case 0:
+		msg = "no tasks"
+	case 1:
+		noun := "task"
+		if t.Sub {
+			noun = "sub-task"
+		}
+		msg = fmt.Sprintf("1 %s: { %s }", noun, items)
+	default:
+		noun := "tasks"
+		if t.Sub {
+			noun = "sub-tasks"
+		}
+		kind := "sequential"
+		if t.Parallel {
+			kind = "parallel"
+		}
+		msg = fmt.Sprintf("%d %s %s: { %s }", len(descriptions), kind, noun, items)
+	}
+
+	if t.DryRun {
+		msg = fmt.Sprintf("(dry-run) %s", msg)
+	}
+	return msg
+}
+
+// DoAllSync calls all tasks in the set sequentially or in parallel, using a
+// background context. Callers that need to support cancellation (e.g. a
+// user pressing Ctrl-C during `create cluster`) should use DoAll instead.
+func (t *TaskTree) DoAllSync() []error {
+	return t.DoAll(context.Background())
+}
+
+// DoAll calls all tasks in the set sequentially or in parallel, aborting
+// promptly once ctx is cancelled. Sequential sub-trees that haven't started
+// yet are skipped entirely rather than launched only to be cancelled right
+// away; tasks that are already in flight are expected to honour ctx
+// themselves and report back on their error channel.
+func (t *TaskTree) DoAll(ctx context.Context) []error {
+	if t.Len() == 0 {
+		return nil
+	}
+
+	if t.DryRun {
+		for _, task := range t.Tasks {
+			logger.Debug("will call %q", task.Describe())
+		}
+		return nil
+	}
+
+	if t.OnEvent != nil && t.eventMu == nil {
+		t.eventMu = &sync.Mutex{}
+	}
+
+	t.emit(TaskEvent{Type: TreeEntered, Info: t.Label})
+	defer t.emit(TaskEvent{Type: TreeExited, Info: t.Label})
+
+	if t.Parallel {
+		return t.doAllParallel(ctx)
+	}
+
+	var errs []error
+	for i, task := range t.Tasks {
+		select {
+		case <-ctx.Done():
+			logger.Debug("context cancelled, skipping remaining sequential tasks")
+			for _, skipped := range t.Tasks[i:] {
+				t.adopt(skipped)
+				t.emit(TaskEvent{Type: TaskSkipped, Info: skipped.Describe()})
+			}
+			return errs
+		default:
+		}
+
+		t.adopt(task)
+		if t.checkpointDone(i, task) {
+			logger.Debug("skipping %q: already completed per checkpoint", task.Describe())
+			t.emit(TaskEvent{Type: TaskSkipped, Info: task.Describe()})
+			continue
+		}
+		if err := t.runTask(ctx, i, task); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// runTask runs a single task to completion, transparently retrying it
+// according to RetryPolicy when it fails with a retryable error, emitting
+// TaskStarted/TaskFinished events around it, and recording success with
+// Checkpointer so a resumed run can skip it next time. index identifies
+// task's position among its siblings in t.Tasks, used to key the
+// Checkpointer so two tasks with the same Describe() text don't collide.
+func (t *TaskTree) runTask(ctx context.Context, index int, task Task) error {
+	start := time.Now()
+	t.emit(TaskEvent{Type: TaskStarted, Info: task.Describe()})
+
+	err := t.attempt(ctx, task)
+	if err == nil {
+		t.checkpointMark(index, task)
+	}
+
+	t.emit(TaskEvent{Type: TaskFinished, Info: task.Describe(), Err: err, Duration: time.Since(start)})
+	return err
+}
+
+// attempt runs task, retrying per RetryPolicy, and returns its final result
+func (t *TaskTree) attempt(ctx context.Context, task Task) error {
+	attempts := t.RetryPolicy.maxAttempts()
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		errCh := make(chan error)
+		if err = task.Do(ctx, errCh); err == nil {
+			err = <-errCh
+		}
+
+		if err == nil || attempt == attempts || !t.RetryPolicy.shouldRetry(err) {
+			return err
+		}
+
+		logger.Debug("task %q failed with %q, retrying (attempt %d/%d)", task.Describe(), err, attempt+1, attempts)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(t.RetryPolicy.backoff(attempt)):
+		}
+	}
+
+	return err
+}
+
+// doAllParallel runs every task in the set concurrently, subject to
+// MaxConcurrency if set. When bounded, tasks are started in order of
+// descending weight (see WeightedTask), so the next worker slot to free up
+// always goes to the heaviest remaining task rather than whichever one
+// happened to be appended first.
+func (t *TaskTree) doAllParallel(ctx context.Context) []error {
+	order := make([]int, len(t.Tasks))
+	for i := range order {
+		order[i] = i
+	}
+
+	var sem chan struct{}
+	if t.MaxConcurrency > 0 {
+		sort.SliceStable(order, func(i, j int) bool {
+			return weightOf(t.Tasks[order[i]]) > weightOf(t.Tasks[order[j]])
+		})
+		sem = make(chan struct{}, t.MaxConcurrency)
+	}
+
+	resultCh := make(chan error)
+	pending := 0
+	for i, idx := range order {
+		task := t.Tasks[idx]
+		t.adopt(task)
+		if t.checkpointDone(idx, task) {
+			logger.Debug("skipping %q: already completed per checkpoint", task.Describe())
+			t.emit(TaskEvent{Type: TaskSkipped, Info: task.Describe()})
+			continue
+		}
+
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				// don't launch this or any later queued task, matching the
+				// sequential tree's behaviour of skipping unstarted work
+				// once the context is cancelled
+				logger.Debug("context cancelled, skipping remaining parallel tasks")
+				for _, remIdx := range order[i:] {
+					remaining := t.Tasks[remIdx]
+					t.adopt(remaining)
+					t.emit(TaskEvent{Type: TaskSkipped, Info: remaining.Describe()})
+				}
+				return t.awaitParallel(resultCh, pending)
+			}
+		}
+		pending++
+
+		go func(taskIdx int, tsk Task) {
+			err := t.runTask(ctx, taskIdx, tsk)
+			if sem != nil {
+				<-sem
+			}
+			resultCh <- err
+		}(idx, task)
+	}
+
+	return t.awaitParallel(resultCh, pending)
+}
+
+// awaitParallel collects the results of pending tasks already launched onto
+// resultCh by doAllParallel
+func (t *TaskTree) awaitParallel(resultCh chan error, pending int) []error {
+	var errs []error
+	for i := 0; i < pending; i++ {
+		if err := <-resultCh; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Do runs the tree as a single task of a parent tree, so that nested
+// TaskTrees can be appended just like leaf tasks
+func (t *TaskTree) Do(ctx context.Context, allErrs chan error) error {
+	go func() {
+		allErrs <- joinErrors(t.DoAll(ctx))
+		close(allErrs)
+	}()
+	return nil
+}
+
+// joinErrors collapses a slice of errors into the single error a task's
+// channel is expected to carry, without losing any of the messages
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		return fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+}
+
+// taskWithoutParams adapts a plain function into a Task
+type taskWithoutParams struct {
+	info string
+	call func(ctx context.Context, errs chan error) error
+}
+
+func (t *taskWithoutParams) Describe() string {
+	return t.info
+}
+
+func (t *taskWithoutParams) Do(ctx context.Context, errs chan error) error {
+	return t.call(ctx, errs)
+}
@@ -1,7 +1,9 @@
 package manager
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -11,6 +13,17 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
+// weightedTestTask adds a fixed Weight to a taskWithoutParams, so tests can
+// exercise MaxConcurrency's weight-based scheduling
+type weightedTestTask struct {
+	taskWithoutParams
+	weight int
+}
+
+func (w *weightedTestTask) Weight() int {
+	return w.weight
+}
+
 var _ = Describe("StackCollection Tasks", func() {
 	var (
 		p   *mockprovider.MockProvider
@@ -96,7 +109,7 @@ var _ = Describe("StackCollection Tasks", func() {
 					subTask1 := &TaskTree{Parallel: false, Sub: true}
 					subTask1.Append(&taskWithoutParams{
 						info: "t1.1",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(100 * time.Millisecond)
 								called11 = true
@@ -113,7 +126,7 @@ var _ = Describe("StackCollection Tasks", func() {
 					subTask2 := &TaskTree{Parallel: false, Sub: true}
 					subTask2.Append(&taskWithoutParams{
 						info: "t2.1",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(150 * time.Millisecond)
 								called21 = true
@@ -131,7 +144,7 @@ var _ = Describe("StackCollection Tasks", func() {
 					subTask3 := &TaskTree{Parallel: true, Sub: true}
 					subTask3.Append(&taskWithoutParams{
 						info: "t3.1",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(200 * time.Millisecond)
 								called31 = true
@@ -143,7 +156,7 @@ var _ = Describe("StackCollection Tasks", func() {
 					})
 					subTask3.Append(&taskWithoutParams{
 						info: "t3.2",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(350 * time.Millisecond)
 								called32 = true
@@ -185,7 +198,7 @@ var _ = Describe("StackCollection Tasks", func() {
 
 					tasks.Append(&taskWithoutParams{
 						info: "t1.1",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(10 * time.Millisecond)
 								errs <- nil
@@ -197,7 +210,7 @@ var _ = Describe("StackCollection Tasks", func() {
 
 					tasks.Append(&taskWithoutParams{
 						info: "t1.2",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(100 * time.Millisecond)
 								errs <- fmt.Errorf("t1.2 always fails")
@@ -209,7 +222,7 @@ var _ = Describe("StackCollection Tasks", func() {
 
 					tasks.Append(&taskWithoutParams{
 						info: "t1.3",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								errs <- fmt.Errorf("t1.3 always fails")
 								close(errs)
@@ -234,7 +247,7 @@ var _ = Describe("StackCollection Tasks", func() {
 
 					tasks.Append(&taskWithoutParams{
 						info: "t1.1",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(100 * time.Millisecond)
 								errs <- fmt.Errorf("t1.1 always fails")
@@ -246,7 +259,7 @@ var _ = Describe("StackCollection Tasks", func() {
 
 					tasks.Append(&taskWithoutParams{
 						info: "t1.3",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								time.Sleep(150 * time.Millisecond)
 								errs <- nil
@@ -258,7 +271,7 @@ var _ = Describe("StackCollection Tasks", func() {
 
 					tasks.Append(&taskWithoutParams{
 						info: "t1.3",
-						call: func(errs chan error) error {
+						call: func(ctx context.Context, errs chan error) error {
 							go func() {
 								errs <- fmt.Errorf("t1.3 always fails")
 								close(errs)
@@ -279,6 +292,170 @@ var _ = Describe("StackCollection Tasks", func() {
 				}
 
 			})
+
+			It("bounds concurrency and schedules by weight when MaxConcurrency is set", func() {
+				var mu sync.Mutex
+				current := 0
+				maxConcurrent := 0
+				var startOrder []string
+
+				makeTask := func(name string, weight int, sleep time.Duration) Task {
+					return &weightedTestTask{
+						taskWithoutParams: taskWithoutParams{
+							info: name,
+							call: func(ctx context.Context, errs chan error) error {
+								go func() {
+									mu.Lock()
+									startOrder = append(startOrder, name)
+									current++
+									if current > maxConcurrent {
+										maxConcurrent = current
+									}
+									mu.Unlock()
+
+									time.Sleep(sleep)
+
+									mu.Lock()
+									current--
+									mu.Unlock()
+
+									errs <- nil
+									close(errs)
+								}()
+								return nil
+							},
+						},
+						weight: weight,
+					}
+				}
+
+				// heaviest and heavy both claim the initial two slots, so
+				// which of them is actually scheduled to run first is not
+				// guaranteed (Go makes no FIFO promise between goroutines
+				// spawned back to back) - only that both run before medium
+				// and light get a turn. heavy is held open far longer than
+				// heaviest so that, once heaviest's slot frees, medium (the
+				// heavier of the two remaining tasks) gets it before light
+				// does, with no race between medium and light themselves.
+				tasks := &TaskTree{Parallel: true, MaxConcurrency: 2}
+				tasks.Append(makeTask("light", 1, 10*time.Millisecond))
+				tasks.Append(makeTask("heaviest", 5, 30*time.Millisecond))
+				tasks.Append(makeTask("heavy", 3, 200*time.Millisecond))
+				tasks.Append(makeTask("medium", 2, 10*time.Millisecond))
+
+				Expect(tasks.DoAllSync()).To(HaveLen(0))
+
+				Expect(maxConcurrent).To(BeNumerically("<=", 2))
+				Expect(startOrder[:2]).To(ConsistOf("heaviest", "heavy"))
+				Expect(startOrder[2]).To(Equal("medium"))
+				Expect(startOrder[3]).To(Equal("light"))
+			})
+
+			It("retries a task per RetryPolicy until it succeeds", func() {
+				attempts := 0
+				task := &taskWithoutParams{
+					info: "flaky",
+					call: func(ctx context.Context, errs chan error) error {
+						attempts++
+						thisAttempt := attempts
+						go func() {
+							if thisAttempt < 3 {
+								errs <- fmt.Errorf("Throttling: rate exceeded")
+							} else {
+								errs <- nil
+							}
+							close(errs)
+						}()
+						return nil
+					},
+				}
+
+				tasks := &TaskTree{Parallel: false, RetryPolicy: &RetryPolicy{
+					MaxAttempts:    3,
+					InitialBackoff: time.Millisecond,
+				}}
+				tasks.Append(task)
+
+				Expect(tasks.Describe()).To(Equal(`1 task: { flaky (retry x3) }`))
+
+				Expect(tasks.DoAllSync()).To(HaveLen(0))
+				Expect(attempts).To(Equal(3))
+			})
+
+			It("does not retry an error the Retryable predicate rejects", func() {
+				attempts := 0
+				task := &taskWithoutParams{
+					info: "unretryable",
+					call: func(ctx context.Context, errs chan error) error {
+						attempts++
+						go func() {
+							errs <- fmt.Errorf("permanent failure")
+							close(errs)
+						}()
+						return nil
+					},
+				}
+
+				tasks := &TaskTree{Parallel: false, RetryPolicy: &RetryPolicy{
+					MaxAttempts:    5,
+					InitialBackoff: time.Millisecond,
+					Retryable:      func(err error) bool { return false },
+				}}
+				tasks.Append(task)
+
+				errs := tasks.DoAllSync()
+				Expect(errs).To(HaveLen(1))
+				Expect(attempts).To(Equal(1))
+			})
+
+			It("does not annotate Describe with a retry count that would never retry", func() {
+				tasks := &TaskTree{Parallel: false, RetryPolicy: &RetryPolicy{MaxAttempts: 1}}
+				tasks.Append(&taskWithoutParams{info: "once"})
+				Expect(tasks.Describe()).To(Equal(`1 task: { once }`))
+
+				tasks = &TaskTree{Parallel: false, RetryPolicy: &RetryPolicy{}}
+				tasks.Append(&taskWithoutParams{info: "also-once"})
+				Expect(tasks.Describe()).To(Equal(`1 task: { also-once }`))
+			})
+
+			It("emits TreeEntered and TaskSkipped events when the context is cancelled mid-run", func() {
+				var mu sync.Mutex
+				var events []TaskEvent
+				recordEvent := func(evt TaskEvent) {
+					mu.Lock()
+					defer mu.Unlock()
+					events = append(events, evt)
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				tasks := &TaskTree{Parallel: false, OnEvent: recordEvent}
+				tasks.Append(&taskWithoutParams{
+					info: "first",
+					call: func(ctx context.Context, errs chan error) error {
+						go func() {
+							cancel()
+							errs <- nil
+							close(errs)
+						}()
+						return nil
+					},
+				})
+				tasks.Append(&taskWithoutParams{info: "second"})
+
+				Expect(tasks.DoAll(ctx)).To(HaveLen(0))
+
+				Expect(events[0].Type).To(Equal(TreeEntered))
+
+				var skipped []string
+				for _, evt := range events {
+					if evt.Type == TaskSkipped {
+						skipped = append(skipped, evt.Info)
+					}
+				}
+				Expect(skipped).To(Equal([]string{"second"}))
+			})
 		})
 
 		Context("With real tasks", func() {